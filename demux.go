@@ -0,0 +1,137 @@
+package seq
+
+import "sync"
+
+// StreamID identifies one of the independent streams managed by a
+// Demuxer.  It must be a valid map key -- an int64 or string are the
+// common choices.
+type StreamID interface{}
+
+// StreamItem tags a Sequenced item with the StreamID of the stream it
+// was produced on, as delivered by Demuxer.Aggregate.
+type StreamItem struct {
+	StreamID StreamID
+	Sequenced
+}
+
+// DemuxerOptions configures a Demuxer created with
+// NewDemuxerWithOptions.
+type DemuxerOptions struct {
+	// NewSequencer creates the *Sequencer used for a newly seen
+	// stream.  Defaults to NewSequencer, but can be set to, for
+	// example, call NewSequencerWithOptions with a MaxQueue and
+	// OnOverflow policy shared by every stream.
+	NewSequencer func() *Sequencer
+}
+
+// A Demuxer manages many independent, interleaved sequences at once,
+// identified by StreamID, reordering each one independently with its
+// own *Sequencer.  This mirrors demultiplexing packets belonging to
+// many logical streams off of a single connection.
+type Demuxer struct {
+	newSequencer func() *Sequencer
+
+	mu      sync.Mutex
+	streams map[StreamID]*Sequencer
+	agg     chan StreamItem
+}
+
+// NewDemuxer creates a new, empty Demuxer.
+func NewDemuxer() *Demuxer {
+	return NewDemuxerWithOptions(DemuxerOptions{})
+}
+
+// NewDemuxerWithOptions creates a new, empty Demuxer configured with
+// the given options.
+func NewDemuxerWithOptions(opts DemuxerOptions) *Demuxer {
+	newSequencer := opts.NewSequencer
+	if newSequencer == nil {
+		newSequencer = NewSequencer
+	}
+
+	return &Demuxer{
+		newSequencer: newSequencer,
+		streams:      make(map[StreamID]*Sequencer),
+		agg:          make(chan StreamItem),
+	}
+}
+
+// streamLocked returns the Sequencer for streamID, creating it the
+// first time streamID is seen.  created reports whether this call was
+// the one that created it, so the caller can decide whether to start
+// the forwarder that feeds Aggregate -- Channel callers want the raw
+// channel to themselves, not a forwarder competing for the same
+// receives.
+func (d *Demuxer) streamLocked(streamID StreamID) (s *Sequencer, created bool) {
+	s, ok := d.streams[streamID]
+	if ok {
+		return s, false
+	}
+
+	s = d.newSequencer()
+	d.streams[streamID] = s
+
+	return s, true
+}
+
+// forwardLocked starts the goroutine that feeds s's output into
+// Aggregate, tagged with streamID.
+func (d *Demuxer) forwardLocked(streamID StreamID, s *Sequencer) {
+	go func() {
+		for item := range s.C {
+			d.agg <- StreamItem{StreamID: streamID, Sequenced: item}
+		}
+	}()
+}
+
+// Add adds seq to the stream identified by streamID, creating a new
+// Sequencer for that stream if this is the first item seen for it.  A
+// stream created by Add is fed into Aggregate.
+func (d *Demuxer) Add(streamID StreamID, seq Sequenced) error {
+	d.mu.Lock()
+	s, created := d.streamLocked(streamID)
+	if created {
+		d.forwardLocked(streamID, s)
+	}
+	d.mu.Unlock()
+
+	return s.Add(seq)
+}
+
+// Channel returns the in-order channel for streamID, creating the
+// stream if this is the first reference to it.  A stream first seen
+// through Channel is not forwarded into Aggregate -- the returned
+// channel is its only reader, so Channel and Aggregate must not both
+// be used to consume the same stream.
+func (d *Demuxer) Channel(streamID StreamID) <-chan Sequenced {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	s, _ := d.streamLocked(streamID)
+	return s.C
+}
+
+// Close tells the Sequencer for streamID that no more items are
+// coming for it, and forgets the stream.  It is a no-op if streamID
+// has never been seen.  It returns an error if that stream had items
+// queued that were never delivered, per Sequencer.Done.
+func (d *Demuxer) Close(streamID StreamID) error {
+	d.mu.Lock()
+	s, ok := d.streams[streamID]
+	delete(d.streams, streamID)
+	d.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	return s.Done()
+}
+
+// Aggregate returns a single fan-in channel delivering in-order items
+// from every stream the Demuxer has seen, each tagged with the
+// StreamID it came from.  Items from different streams may interleave
+// with each other, but ordering within a single stream is preserved.
+func (d *Demuxer) Aggregate() <-chan StreamItem {
+	return d.agg
+}
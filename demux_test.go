@@ -0,0 +1,91 @@
+package seq
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDemuxer(t *testing.T) {
+	d := NewDemuxer()
+
+	go func() {
+		d.Add("a", seqint(1)) // buffered
+		d.Add("b", seqint(0)) // sent
+		d.Add("a", seqint(0)) // 0 & 1 sent for "a"
+		d.Add("b", seqint(1)) // sent
+		d.Close("a")
+		d.Close("b")
+	}()
+
+	got := make(map[StreamID][]int64)
+	for i := 0; i < 4; i++ {
+		item := <-d.Aggregate()
+		got[item.StreamID] = append(got[item.StreamID], item.Pos())
+	}
+
+	if !reflect.DeepEqual(got["a"], []int64{0, 1}) {
+		t.Fatalf("stream a: got %v, expected [0 1]", got["a"])
+	}
+	if !reflect.DeepEqual(got["b"], []int64{0, 1}) {
+		t.Fatalf("stream b: got %v, expected [0 1]", got["b"])
+	}
+}
+
+func TestDemuxerWithOptions(t *testing.T) {
+	// A custom NewSequencer bounding every stream to a 1-item queue
+	// with the Error overflow policy -- something the default
+	// NewSequencer would never do, so seeing it take effect confirms
+	// the hook is actually used for new streams.
+	d := NewDemuxerWithOptions(DemuxerOptions{
+		NewSequencer: func() *Sequencer {
+			return NewSequencerWithOptions(SequencerOptions{MaxQueue: 1, OnOverflow: Error})
+		},
+	})
+
+	errs := make(chan error, 1)
+	go func() {
+		d.Add("a", seqint(1))         // fills the stream's 1-item queue
+		errs <- d.Add("a", seqint(2)) // queue is full: should be rejected
+		d.Add("a", seqint(0))         // 0 & 1 sent; 2 was never queued
+		d.Close("a")
+	}()
+
+	got := make(map[StreamID][]int64)
+	for i := 0; i < 2; i++ {
+		item := <-d.Aggregate()
+		got[item.StreamID] = append(got[item.StreamID], item.Pos())
+	}
+	if !reflect.DeepEqual(got["a"], []int64{0, 1}) {
+		t.Fatalf("stream a: got %v, expected [0 1]", got["a"])
+	}
+
+	if err := <-errs; err == nil || !strings.Contains(err.Error(), "seq: queue full") {
+		t.Fatalf("Add(\"a\", 2): got %v, expected a queue-full error from the stream's custom MaxQueue", err)
+	}
+}
+
+func TestDemuxerChannel(t *testing.T) {
+	// A stream consumed via Channel, with Aggregate never read at all
+	// -- the forwarder must not be wired up for it, or it would race
+	// Channel's caller for the same receives and then block forever
+	// trying to forward into an Aggregate nobody's reading.
+	d := NewDemuxer()
+	ch := d.Channel("a")
+
+	go func() {
+		d.Add("a", seqint(1)) // buffered
+		d.Add("a", seqint(0)) // 0 & 1 sent
+		d.Close("a")
+	}()
+
+	for _, want := range []int64{0, 1} {
+		if got := (<-ch).Pos(); got != want {
+			t.Fatalf("got %d, expected %d", got, want)
+		}
+	}
+
+	if _, ok := <-ch; ok {
+		t.Fatal("expected the channel to be closed after Close")
+	}
+}
@@ -0,0 +1,204 @@
+package seq
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The PrioritizedSequenced interface represents a piece of data
+// belonging within a sequence that also carries a priority level.
+type PrioritizedSequenced interface {
+	Sequenced
+
+	// Priority returns this item's priority level.  Numerically
+	// higher levels are preferred: a PrioritySequencer will not
+	// deliver anything from a lower level while a higher level has
+	// an item ready to send.
+	Priority() int
+}
+
+// priorityLevel holds the independent in-order state -- its own
+// NextPos and queue -- for a single priority level of a
+// PrioritySequencer.
+type priorityLevel struct {
+	nextPos int64
+	queue   sequencedHeap
+	queued  map[int64]struct{}
+}
+
+// A PrioritySequencer receives PrioritizedSequenced instances out of
+// order, across any number of priority levels, and produces them on
+// its channel (C) in order within each level.  Whenever more than one
+// level has an item ready to send, the highest level wins: delivery
+// only comes from level N once every level above N has nothing ready
+// at its current position.
+//
+// Because Go's select does not guarantee which ready case runs,
+// levels cannot be arbitrated with a select over one channel per
+// level.  Instead a single goroutine holds a sync.Cond, and each time
+// it wakes it scans every level from the top down and sends the first
+// ready item it finds.
+type PrioritySequencer struct {
+	// C is a channel which produces PrioritizedSequenced items in
+	// order, within each priority level, as they become available.
+	C chan PrioritizedSequenced
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	levels map[int]*priorityLevel
+	done   bool
+}
+
+// NewPrioritySequencer creates a new PrioritySequencer, initializing
+// the C channel and starting its delivery goroutine.
+func NewPrioritySequencer() *PrioritySequencer {
+	ps := &PrioritySequencer{
+		C:      make(chan PrioritizedSequenced),
+		levels: make(map[int]*priorityLevel),
+	}
+	ps.cond = sync.NewCond(&ps.mu)
+
+	go ps.run()
+
+	return ps
+}
+
+func (ps *PrioritySequencer) levelLocked(priority int) *priorityLevel {
+	lvl, ok := ps.levels[priority]
+	if !ok {
+		lvl = &priorityLevel{queued: make(map[int64]struct{})}
+		ps.levels[priority] = lvl
+	}
+	return lvl
+}
+
+// sortedLevelsLocked returns every priority level currently known,
+// highest first.
+func (ps *PrioritySequencer) sortedLevelsLocked() []int {
+	levels := make([]int, 0, len(ps.levels))
+	for p := range ps.levels {
+		levels = append(levels, p)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(levels)))
+	return levels
+}
+
+// readyLocked scans every level from the top down, returning the
+// first item found sitting at its level's NextPos.
+func (ps *PrioritySequencer) readyLocked() (queueItem, int, bool) {
+	for _, p := range ps.sortedLevelsLocked() {
+		lvl := ps.levels[p]
+		if lvl.queue.Len() == 0 {
+			continue
+		}
+		if lvl.queue[0].trueSeq == lvl.nextPos {
+			return lvl.queue[0], p, true
+		}
+	}
+	return queueItem{}, 0, false
+}
+
+// run is the PrioritySequencer's delivery goroutine.  It wakes
+// whenever Add or Done may have changed what's ready, scans levels
+// top-down, and sends the first ready item -- strictly preferring
+// higher levels over lower ones.
+func (ps *PrioritySequencer) run() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	for {
+		item, priority, ok := ps.readyLocked()
+		if ok {
+			lvl := ps.levels[priority]
+			heap.Pop(&lvl.queue)
+			delete(lvl.queued, item.trueSeq)
+			lvl.nextPos++
+
+			ps.mu.Unlock()
+			ps.C <- item.seq.(PrioritizedSequenced)
+			ps.mu.Lock()
+
+			continue
+		}
+
+		if ps.done {
+			close(ps.C)
+			return
+		}
+
+		ps.cond.Wait()
+	}
+}
+
+// Add adds a PrioritizedSequenced instance to the PrioritySequencer.
+// Items can be added in any order, within or across priority levels.
+//
+// Add panics if Done() has previously been called on it.
+func (ps *PrioritySequencer) Add(seq PrioritizedSequenced) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.done {
+		panic("cannot add to a closed sequencer")
+	}
+
+	lvl := ps.levelLocked(seq.Priority())
+	pos := seq.Pos()
+
+	if pos < lvl.nextPos {
+		// Ignore re-delivered messages with lower sequence
+		// numbers than we're expecting for this level.
+		return
+	}
+
+	if _, queued := lvl.queued[pos]; queued {
+		return
+	}
+
+	heap.Push(&lvl.queue, queueItem{seq: seq, trueSeq: pos})
+	lvl.queued[pos] = struct{}{}
+
+	ps.cond.Broadcast()
+}
+
+// Done tells the PrioritySequencer to close its channel.  Any attempt
+// to Add following this call will panic.  This function returns an
+// error describing every priority level that still has a gap -- an
+// item it expected but never got -- at the time it was called.
+func (ps *PrioritySequencer) Done() error {
+	ps.mu.Lock()
+
+	ps.done = true
+	ps.cond.Broadcast()
+
+	var gaps []string
+	for _, p := range ps.sortedLevelsLocked() {
+		lvl := ps.levels[p]
+		if lvl.queue.Len() != 0 && lvl.queue[0].trueSeq != lvl.nextPos {
+			gaps = append(gaps, fmt.Sprintf("priority %d: never got item at position %d", p, lvl.nextPos))
+		}
+	}
+
+	ps.mu.Unlock()
+
+	if len(gaps) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s", strings.Join(gaps, "; "))
+}
+
+// QueueLen returns the number of items currently queued at the given
+// priority level, waiting for the value at that level's NextPos.
+func (ps *PrioritySequencer) QueueLen(priority int) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	lvl, ok := ps.levels[priority]
+	if !ok {
+		return 0
+	}
+	return lvl.queue.Len()
+}
@@ -0,0 +1,58 @@
+package seq
+
+import (
+	"strings"
+	"testing"
+)
+
+type prioritizedInt struct {
+	pos      int64
+	priority int
+}
+
+func (p prioritizedInt) Pos() int64    { return p.pos }
+func (p prioritizedInt) Priority() int { return p.priority }
+
+func TestPrioritySequencer(t *testing.T) {
+	ps := NewPrioritySequencer()
+
+	// Nothing else exists yet, so this is the only item run() can
+	// possibly pick -- it'll be dequeued and left blocked trying to
+	// send, since nothing has read from C yet.
+	ps.Add(prioritizedInt{pos: 0, priority: 5})
+
+	item := <-ps.C
+	if item.Priority() != 5 || item.Pos() != 0 {
+		t.Fatalf("got priority %d pos %d, expected priority 5 pos 0", item.Priority(), item.Pos())
+	}
+
+	// Queue a higher- and a lower-priority item at the same
+	// position before reading again, so both are genuinely ready
+	// the next time run() looks.
+	ps.Add(prioritizedInt{pos: 0, priority: 2}) // higher
+	ps.Add(prioritizedInt{pos: 0, priority: 1}) // lower
+
+	item = <-ps.C
+	if item.Priority() != 2 {
+		t.Fatalf("got priority %d, expected priority 2 to preempt priority 1", item.Priority())
+	}
+
+	item = <-ps.C
+	if item.Priority() != 1 {
+		t.Fatalf("got priority %d, expected priority 1", item.Priority())
+	}
+
+	if err := ps.Done(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A level that never gets its expected item is reported by
+	// Done, by priority level.
+	ps2 := NewPrioritySequencer()
+	ps2.Add(prioritizedInt{pos: 1, priority: 0})
+
+	err := ps2.Done()
+	if err == nil || !strings.Contains(err.Error(), "priority 0") {
+		t.Fatalf("got %v, expected an error mentioning priority 0", err)
+	}
+}
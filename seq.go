@@ -3,8 +3,10 @@
 package seq
 
 import (
+	"container/heap"
 	"fmt"
-	"sort"
+	"sync"
+	"time"
 )
 
 // The Sequenced interface represents a piece of data belonging within a
@@ -14,24 +16,82 @@ type Sequenced interface {
 	Pos() int64
 }
 
-// SequencedSlice is a slice of Sequenced instances, implementing the
-// sort.Interface interface.
-type SequencedSlice []Sequenced
+// queueItem pairs a queued Sequenced with its trueSeq, the expansion
+// of its (possibly wrapped) Pos() into the Sequencer's unbounded
+// position space.  See Sequencer.WrapMask.
+type queueItem struct {
+	seq     Sequenced
+	trueSeq int64
+}
+
+// sequencedHeap is a min-heap of queueItems ordered by trueSeq,
+// implementing container/heap.Interface.
+type sequencedHeap []queueItem
 
-// Search finds the provided Sequenced instance in a sorted
-// SequencedSlice, using the sort.Search function.  If found, it
-// returns the current position of the item and true.  If not found,
-// it returns the position where this item would be inserted into the
-// sorted slice, and false.
-func (ss SequencedSlice) Search(seq Sequenced) (int, bool) {
-	pos := seq.Pos()
+func (h sequencedHeap) Len() int           { return len(h) }
+func (h sequencedHeap) Less(i, j int) bool { return h[i].trueSeq < h[j].trueSeq }
+func (h sequencedHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
 
-	i := sort.Search(len(ss), func(i int) bool {
-		return ss[i].Pos() >= pos
-	})
+func (h *sequencedHeap) Push(x interface{}) {
+	*h = append(*h, x.(queueItem))
+}
 
-	exists := (i < len(ss) && ss[i].Pos() == pos)
-	return i, exists
+func (h *sequencedHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
+// OverflowPolicy controls what a Sequencer does when Add is called
+// while its queue is already at MaxQueue capacity.
+type OverflowPolicy int
+
+const (
+	// BlockAdd makes Add block until the queue has room, which
+	// happens as soon as enough items drain to bring the queue
+	// below MaxQueue.
+	BlockAdd OverflowPolicy = iota
+
+	// DropHighest discards whichever queued item has the highest
+	// trueSeq -- including the item being added, if it is itself
+	// the highest -- to make room for the new arrival.
+	DropHighest
+
+	// Error makes Add return an error instead of queuing the item.
+	Error
+)
+
+// GapAction controls what a Sequencer does when the item it is
+// waiting for at NextPos still hasn't arrived after GapTimeout.
+type GapAction int
+
+const (
+	// Wait leaves the Sequencer waiting for the missing item,
+	// re-arming the gap timer for another GapTimeout period.
+	Wait GapAction = iota
+
+	// Skip gives up on the missing item, advancing NextPos past
+	// the gap to whatever is queued next, and delivering it and
+	// anything already queued behind it.
+	Skip
+
+	// Fail closes C and records an error retrievable with Err().
+	Fail
+)
+
+// SequencerOptions configures a Sequencer created with
+// NewSequencerWithOptions.
+type SequencerOptions struct {
+	// MaxQueue bounds the number of out-of-order items a Sequencer
+	// will hold onto at once.  0 means unbounded.
+	MaxQueue int
+
+	// OnOverflow determines what happens when Add is called while
+	// the queue is at MaxQueue capacity.  It is ignored when
+	// MaxQueue is 0.
+	OnOverflow OverflowPolicy
 }
 
 // A Sequencer receives Sequenced instances out of order, and produces
@@ -46,42 +106,267 @@ type Sequencer struct {
 	// by callers prior to calling Add().
 	NextPos int64
 
-	queue SequencedSlice
-	done  bool
+	// MaxQueue bounds the number of out-of-order items held in the
+	// queue at once.  0 means unbounded.  See SequencerOptions.
+	MaxQueue int
+
+	// OnOverflow determines what Add does when the queue is full.
+	// See SequencerOptions.
+	OnOverflow OverflowPolicy
+
+	// WrapMask configures Pos() to be treated as a fixed-width
+	// counter that wraps back to 0 after reaching WrapMask, such
+	// as a uint32 TCP or RTP sequence number (WrapMask
+	// 0xffffffff).  0, the default, disables wraparound handling
+	// and treats Pos() as an unbounded int64, matching prior
+	// behavior.
+	WrapMask int64
+
+	// WindowSize bounds how far ahead of NextPos (mod WrapMask+1)
+	// an item may be before it is considered to belong to a new
+	// epoch rather than simply being a duplicate from the epoch
+	// that just ended.  It is ignored when WrapMask is 0.  0 means
+	// no bound: of the two possible readings, whichever is closer
+	// to NextPos is used.
+	WindowSize int64
+
+	// GapTimeout, if non-zero, bounds how long the Sequencer will
+	// wait for the item at NextPos before invoking OnGap.  The
+	// timer is armed whenever the head of the queue is not at
+	// NextPos, and disarmed as soon as it is.
+	GapTimeout time.Duration
+
+	// OnGap is called when GapTimeout elapses with nothing at
+	// NextPos, with the position that never arrived.  It returns
+	// what the Sequencer should do about it.  A nil OnGap is
+	// treated as always returning Wait.
+	OnGap func(missing int64) GapAction
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	rev      int64
+	queue    sequencedHeap
+	queued   map[int64]struct{}
+	done     bool
+	sending  bool
+	gapTimer *time.Timer
+	err      error
 }
 
 // NewSequencer creates a new Sequencer, initializing the C channel.
 func NewSequencer() *Sequencer {
-	var s Sequencer
-	s.C = make(chan Sequenced)
-	return &s
+	return NewSequencerWithOptions(SequencerOptions{})
 }
 
-func (s *Sequencer) insert(i int, seq Sequenced) {
-	s.queue = append(s.queue, nil)
-	copy(s.queue[i+1:], s.queue[i:])
-	s.queue[i] = seq
+// NewSequencerWithOptions creates a new Sequencer configured with the
+// given options, initializing the C channel.
+func NewSequencerWithOptions(opts SequencerOptions) *Sequencer {
+	s := &Sequencer{
+		C:          make(chan Sequenced),
+		MaxQueue:   opts.MaxQueue,
+		OnOverflow: opts.OnOverflow,
+		queued:     make(map[int64]struct{}),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
 }
 
-func (s *Sequencer) send(seq Sequenced) {
+// trueSeqLocked expands a raw, possibly-wrapped Pos() into the
+// Sequencer's unbounded position space, relative to the current
+// NextPos and rev.  ok is false when WindowSize is set and pos is too
+// far from NextPos, in either direction, to place unambiguously.
+func (s *Sequencer) trueSeqLocked(pos int64) (trueSeq int64, ok bool) {
+	if s.WrapMask == 0 {
+		return pos, true
+	}
+
+	modulus := s.WrapMask + 1
+	localNext := s.NextPos % modulus
+
+	forward := pos - localNext
+	if forward < 0 {
+		forward += modulus
+	}
+
+	backward := modulus - forward
+	if forward == 0 {
+		backward = 0
+	}
+
+	if s.WindowSize > 0 && forward > s.WindowSize && backward > s.WindowSize {
+		return 0, false
+	}
+
+	rev := s.rev
+	if forward <= backward {
+		// pos reads as ahead of (or at) NextPos.
+		if pos < localNext {
+			rev++
+		}
+	} else {
+		// pos reads as behind NextPos -- a duplicate, probably
+		// from the epoch that just ended.
+		if pos > localNext {
+			rev--
+		}
+	}
+
+	return rev*modulus + pos, true
+}
+
+// sendLocked delivers seq on C.  It releases s.mu for the blocking
+// channel send -- matching PrioritySequencer.run's convention of never
+// holding the lock against a slow consumer -- so that QueueLen, Done,
+// and a concurrent Add are never stuck behind one. s.sending marks the
+// send in flight so other callers that would otherwise race to decide
+// what happens next at the same NextPos wait for it via
+// waitForSendLocked instead.
+func (s *Sequencer) sendLocked(seq Sequenced) {
+	s.sending = true
+	s.mu.Unlock()
 	s.C <- seq
+	s.mu.Lock()
+	s.sending = false
+	s.cond.Broadcast()
+
 	s.NextPos++
+	if s.WrapMask != 0 && s.NextPos%(s.WrapMask+1) == 0 {
+		s.rev++
+	}
+}
+
+// waitForSendLocked blocks until any send currently in flight has
+// finished, so its caller sees a NextPos/queue consistent with that
+// send having fully completed rather than racing its unlocked window.
+func (s *Sequencer) waitForSendLocked() {
+	for s.sending {
+		s.cond.Wait()
+	}
+}
+
+func (s *Sequencer) drainLocked() {
+	for {
+		s.waitForSendLocked()
+
+		if s.queue.Len() == 0 || s.queue[0].trueSeq != s.NextPos {
+			break
+		}
+
+		item := heap.Pop(&s.queue).(queueItem)
+		delete(s.queued, item.trueSeq)
+		s.cond.Broadcast()
+
+		s.sendLocked(item.seq)
+	}
+
+	s.updateGapTimerLocked()
+}
+
+// updateGapTimerLocked arms the gap timer, if it isn't armed already,
+// when the queue is non-empty and its head isn't at NextPos, and
+// disarms it otherwise.  It deliberately leaves an already-armed
+// timer alone: GapTimeout bounds how long NextPos may be missing for,
+// so items arriving behind it must not keep pushing that deadline
+// back out.
+func (s *Sequencer) updateGapTimerLocked() {
+	if s.done || s.GapTimeout <= 0 || s.queue.Len() == 0 || s.queue[0].trueSeq == s.NextPos {
+		if s.gapTimer != nil {
+			s.gapTimer.Stop()
+			s.gapTimer = nil
+		}
+		return
+	}
+
+	if s.gapTimer == nil {
+		s.gapTimer = time.AfterFunc(s.GapTimeout, s.onGapTimeout)
+	}
 }
 
-func (s *Sequencer) drain() {
-	for len(s.queue) > 0 {
-		seq := s.queue[0]
+// onGapTimeout runs, in its own goroutine, GapTimeout after the gap
+// timer was last armed.  The gap may have since been resolved --
+// Add and Done both stop the timer as soon as it is -- so this
+// re-checks before doing anything.
+func (s *Sequencer) onGapTimeout() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.waitForSendLocked()
+
+	if s.done || s.queue.Len() == 0 || s.queue[0].trueSeq == s.NextPos {
+		return
+	}
+
+	missing := s.NextPos
+
+	action := Wait
+	if s.OnGap != nil {
+		action = s.OnGap(missing)
+	}
+
+	switch action {
+	case Skip:
+		// The fired timer is spent; drop it so drainLocked's
+		// call to updateGapTimerLocked re-arms a fresh one if a
+		// gap remains, instead of assuming one is still running.
+		s.gapTimer = nil
 
-		pos := seq.Pos()
-		if pos != s.NextPos {
-			return
+		s.NextPos = s.queue[0].trueSeq
+		if s.WrapMask != 0 {
+			s.rev = s.NextPos / (s.WrapMask + 1)
 		}
+		s.drainLocked()
 
-		s.send(seq)
-		s.queue = s.queue[1:]
+	case Fail:
+		s.err = fmt.Errorf("Never got item at position %d", missing)
+		close(s.C)
+		s.done = true
+		s.cond.Broadcast()
+		if s.gapTimer != nil {
+			s.gapTimer.Stop()
+			s.gapTimer = nil
+		}
+
+	case Wait:
+		// The fired timer is spent; drop it so
+		// updateGapTimerLocked re-arms a fresh one instead of
+		// assuming one is already running.
+		s.gapTimer = nil
+		s.updateGapTimerLocked()
 	}
 }
 
+// highestQueuedLocked returns the index of the queued item with the
+// largest trueSeq, which the heap invariant does not otherwise
+// expose.
+func (s *Sequencer) highestQueuedLocked() int {
+	hi := 0
+	for i := 1; i < len(s.queue); i++ {
+		if s.queue[i].trueSeq > s.queue[hi].trueSeq {
+			hi = i
+		}
+	}
+	return hi
+}
+
+// dispatchIfDueLocked handles a trueSeq that's no longer in the
+// future: it discards one that's now a stale duplicate, sends and
+// drains one that's exactly due, and reports false for anything still
+// ahead of NextPos so the caller can queue it.
+func (s *Sequencer) dispatchIfDueLocked(seq Sequenced, trueSeq int64) bool {
+	s.waitForSendLocked()
+
+	switch {
+	case trueSeq < s.NextPos:
+		return true
+
+	case trueSeq == s.NextPos:
+		s.sendLocked(seq)
+		s.drainLocked()
+		return true
+	}
+	return false
+}
+
 // The Add function adds a Sequenced instance to the Sequencer.  Items
 // can be added in any order.
 //
@@ -90,53 +375,135 @@ func (s *Sequencer) drain() {
 // also sent.
 //
 // If an added item's Pos() is greater than NextPos, it is queued up
-// to be sent as soon as it can.
+// to be sent as soon as it can.  If the queue is already at MaxQueue
+// capacity, OnOverflow determines what happens: BlockAdd waits for
+// room to free up, DropHighest discards whichever of the new item and
+// the current queue has the higher position, and Error returns an
+// error without queuing the item.
 //
 // If an added item's Pos() is lower than NextPos -- indicating that
 // it is a repeated value -- it is discarded.
 //
+// When WrapMask is set, Pos() is first expanded against NextPos and
+// WindowSize as described on those fields before any of the above
+// comparisons are made.
+//
+// If GapTimeout is set and the item at NextPos still hasn't shown up
+// GapTimeout after it was first needed, OnGap is consulted; see those
+// fields for what happens next.
+//
 // Add panics if Done() has previously been called on it.
-func (s *Sequencer) Add(seq Sequenced) {
+func (s *Sequencer) Add(seq Sequenced) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	if s.done {
 		panic("cannot add to a closed sequencer")
 	}
 
-	pos := seq.Pos()
+	trueSeq, ok := s.trueSeqLocked(seq.Pos())
+	if !ok {
+		// Too far from NextPos in either direction to place
+		// unambiguously -- treat it as a stale duplicate.
+		return nil
+	}
 
-	switch {
-	case pos < s.NextPos:
-		// Ignore re-delivered messages with lower sequence
-		// numbers than we're expecting
-
-	case pos == s.NextPos:
-		s.send(seq)
-		s.drain()
-
-	case pos > s.NextPos:
-		i, exists := s.queue.Search(seq)
-		if !exists {
-			s.insert(i, seq)
+	if s.dispatchIfDueLocked(seq, trueSeq) {
+		return nil
+	}
+
+	if _, queued := s.queued[trueSeq]; queued {
+		return nil
+	}
+
+	for s.MaxQueue > 0 && s.queue.Len() >= s.MaxQueue {
+		switch s.OnOverflow {
+		case DropHighest:
+			hi := s.highestQueuedLocked()
+			if s.queue[hi].trueSeq < trueSeq {
+				// Everything queued is already lower
+				// than the new item, so the new item is
+				// the one that gets dropped.
+				return nil
+			}
+
+			delete(s.queued, s.queue[hi].trueSeq)
+			heap.Remove(&s.queue, hi)
+
+		case Error:
+			return fmt.Errorf("seq: queue full at %d items", s.MaxQueue)
+
+		case BlockAdd:
+			s.cond.Wait()
+
+			if s.done {
+				panic("cannot add to a closed sequencer")
+			}
 		}
 	}
+
+	// BlockAdd's Wait above releases the lock, so NextPos may have
+	// moved past trueSeq by the time we get it back -- recheck rather
+	// than queuing something that's now stale or already due.
+	if s.dispatchIfDueLocked(seq, trueSeq) {
+		return nil
+	}
+
+	heap.Push(&s.queue, queueItem{seq: seq, trueSeq: trueSeq})
+	s.queued[trueSeq] = struct{}{}
+
+	s.updateGapTimerLocked()
+
+	return nil
 }
 
 // Done tells the Sequencer to close its channel.  Any attempt to Add
 // following this call will panic.  This function will return an error
 // if there are any items queued that could not be sent to the
-// channel.
+// channel.  If OnGap already closed C with Fail, that error is
+// returned instead, and C is not closed again.
 func (s *Sequencer) Done() error {
-	close(s.C)
-	s.done = true
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.waitForSendLocked()
+
+	if !s.done {
+		close(s.C)
+		s.done = true
+	}
+	s.cond.Broadcast()
+
+	if s.gapTimer != nil {
+		s.gapTimer.Stop()
+		s.gapTimer = nil
+	}
 
-	if len(s.queue) != 0 {
+	if s.err != nil {
+		return s.err
+	}
+
+	if s.queue.Len() != 0 {
 		return fmt.Errorf("Never got item at position %d", s.NextPos)
 	}
 
 	return nil
 }
 
+// Err returns the error recorded when OnGap returned Fail, or nil if
+// that has never happened.
+func (s *Sequencer) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
+
 // QueueLen returns the current number of items blocked in the queue,
 // waiting for the value at s.NextPos.
 func (s *Sequencer) QueueLen() int {
-	return len(s.queue)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.queue.Len()
 }
@@ -2,8 +2,10 @@ package seq
 
 import (
 	"math/rand"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 type seqint int64
@@ -111,3 +113,318 @@ func TestSequencer(t *testing.T) {
 		outerSeq.Add(seqint(1))
 	}()
 }
+
+func TestSequencerGapTimeout(t *testing.T) {
+	// Skip: the missing item at position 1 is eventually given up
+	// on, letting 2 and 3 through.
+	s := NewSequencer()
+	s.GapTimeout = 10 * time.Millisecond
+	s.OnGap = func(missing int64) GapAction {
+		if missing != 1 {
+			t.Fatalf("got a gap at %d, expected 1", missing)
+		}
+		return Skip
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		s.Add(seqint(0))
+		s.Add(seqint(3))
+		s.Add(seqint(2))
+	}()
+
+	// 2 and 3 only arrive once the gap timer gives up on 1, which
+	// the producer goroutine above never sends.
+	for _, want := range []int64{0, 2, 3} {
+		got := (<-s.C).Pos()
+		if got != want {
+			t.Fatalf("got %d, expected %d", got, want)
+		}
+	}
+
+	wg.Wait()
+
+	if err := s.Done(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fail: C is closed and the error is retrievable via Err().
+	s2 := NewSequencer()
+	s2.GapTimeout = 10 * time.Millisecond
+	s2.OnGap = func(missing int64) GapAction {
+		return Fail
+	}
+
+	s2.Add(seqint(1))
+
+	if _, ok := <-s2.C; ok {
+		t.Fatal("expected C to be closed")
+	}
+	if s2.Err() == nil {
+		t.Fatal("expected Err() to report the gap")
+	}
+}
+
+func TestSequencerOverflowError(t *testing.T) {
+	s := NewSequencerWithOptions(SequencerOptions{MaxQueue: 2, OnOverflow: Error})
+
+	if err := s.Add(seqint(1)); err != nil {
+		t.Fatalf("Add(1): unexpected error %v", err)
+	}
+	if err := s.Add(seqint(2)); err != nil {
+		t.Fatalf("Add(2): unexpected error %v", err)
+	}
+	assertInt(t, s.QueueLen(), 2)
+
+	err := s.Add(seqint(3))
+	if err == nil {
+		t.Fatal("expected an error once the queue is at MaxQueue")
+	}
+	if !strings.Contains(err.Error(), "seq: queue full") {
+		t.Fatalf("got error %q, expected it to mention \"seq: queue full\"", err)
+	}
+	assertInt(t, s.QueueLen(), 2)
+
+	// The rejected item never joined the queue, so draining 1 and 2
+	// finishes the sequencer cleanly. C is unbuffered, so Add(0) needs
+	// a concurrent reader or it'll block forever with nothing else
+	// running to drain it.
+	got := make(chan int64, 3)
+	go func() {
+		for i := 0; i < 3; i++ {
+			got <- (<-s.C).Pos()
+		}
+	}()
+	s.Add(seqint(0))
+	for _, want := range []int64{0, 1, 2} {
+		if x := <-got; x != want {
+			t.Fatalf("got %d, expected %d", x, want)
+		}
+	}
+	if err := s.Done(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSequencerOverflowDropHighest(t *testing.T) {
+	// The new item is itself the highest position around, so it's the
+	// one that gets dropped, leaving the queue untouched.
+	s := NewSequencerWithOptions(SequencerOptions{MaxQueue: 2, OnOverflow: DropHighest})
+
+	s.Add(seqint(1))
+	s.Add(seqint(2))
+	assertInt(t, s.QueueLen(), 2)
+
+	if err := s.Add(seqint(3)); err != nil {
+		t.Fatalf("Add(3): unexpected error %v", err)
+	}
+	assertInt(t, s.QueueLen(), 2)
+
+	got := make(chan int64, 3)
+	go func() {
+		for i := 0; i < 3; i++ {
+			got <- (<-s.C).Pos()
+		}
+	}()
+	s.Add(seqint(0)) // 0 sent, 1 & 2 drained; 3 was never queued
+	for _, want := range []int64{0, 1, 2} {
+		if x := <-got; x != want {
+			t.Fatalf("got %d, expected %d", x, want)
+		}
+	}
+	if err := s.Done(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The new item is lower than the current highest queued position,
+	// so it evicts that item from the queue instead.
+	s2 := NewSequencerWithOptions(SequencerOptions{MaxQueue: 2, OnOverflow: DropHighest})
+
+	s2.Add(seqint(2))
+	s2.Add(seqint(4))
+	assertInt(t, s2.QueueLen(), 2)
+
+	if err := s2.Add(seqint(1)); err != nil {
+		t.Fatalf("Add(1): unexpected error %v", err)
+	}
+	assertInt(t, s2.QueueLen(), 2) // 4 was evicted to make room for 1
+
+	got2 := make(chan int64, 3)
+	go func() {
+		for i := 0; i < 3; i++ {
+			got2 <- (<-s2.C).Pos()
+		}
+	}()
+	s2.Add(seqint(0)) // 0, 1 & 2 drain; 4 is gone for good
+	for _, want := range []int64{0, 1, 2} {
+		if x := <-got2; x != want {
+			t.Fatalf("got %d, expected %d", x, want)
+		}
+	}
+	// 4 was discarded rather than merely delayed, so Done sees an
+	// empty queue and reports no gap.
+	if err := s2.Done(); err != nil {
+		t.Fatalf("Done: unexpected error %v", err)
+	}
+}
+
+func TestSequencerOverflowBlockAdd(t *testing.T) {
+	s := NewSequencerWithOptions(SequencerOptions{MaxQueue: 1, OnOverflow: BlockAdd})
+
+	// A concurrent reader, since C is unbuffered and nothing else in
+	// this test would otherwise drain it.
+	got := make(chan int64, 3)
+	go func() {
+		for i := 0; i < 3; i++ {
+			got <- (<-s.C).Pos()
+		}
+	}()
+
+	s.Add(seqint(1)) // fills the one slot in the queue
+	assertInt(t, s.QueueLen(), 1)
+
+	blocked := make(chan error, 1)
+	go func() {
+		blocked <- s.Add(seqint(2)) // must block until 1 drains
+	}()
+
+	select {
+	case <-blocked:
+		t.Fatal("Add(2) returned before the queue had room")
+	case <-time.After(20 * time.Millisecond):
+	}
+	assertInt(t, s.QueueLen(), 1)
+
+	// Sending 0 drains 1, which frees the slot BlockAdd is waiting on.
+	// The now-unblocked Add(2) finds itself at NextPos and is sent
+	// rather than merely re-queued.
+	s.Add(seqint(0))
+
+	for _, want := range []int64{0, 1, 2} {
+		if x := <-got; x != want {
+			t.Fatalf("got %d, expected %d", x, want)
+		}
+	}
+
+	select {
+	case err := <-blocked:
+		if err != nil {
+			t.Fatalf("Add(2): unexpected error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Add(2) never returned after the queue drained")
+	}
+
+	if err := s.Done(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSequencerQueueLenDuringSend(t *testing.T) {
+	// With nobody reading C, this Add blocks mid-send holding only the
+	// sending flag, not s.mu -- QueueLen must still return promptly.
+	s := NewSequencer()
+	s.Add(seqint(1)) // queued; doesn't touch C
+
+	addDone := make(chan error, 1)
+	go func() {
+		addDone <- s.Add(seqint(0)) // sends 0, then drains 1
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+
+	queueLen := make(chan int, 1)
+	go func() { queueLen <- s.QueueLen() }()
+
+	select {
+	case n := <-queueLen:
+		assertInt(t, n, 1) // 1 is still queued; 0's send hasn't been read yet
+	case <-time.After(time.Second):
+		t.Fatal("QueueLen blocked behind an in-flight send")
+	}
+
+	for _, want := range []int64{0, 1} {
+		if got := (<-s.C).Pos(); got != want {
+			t.Fatalf("got %d, expected %d", got, want)
+		}
+	}
+
+	if err := <-addDone; err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Done(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSequencerDoneWaitsForInFlightSend(t *testing.T) {
+	// Done must not close C while a send is in flight, or the pending
+	// send would panic instead of completing.
+	s := NewSequencer()
+
+	addDone := make(chan error, 1)
+	go func() {
+		addDone <- s.Add(seqint(0)) // blocks mid-send until C is read
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+
+	doneErr := make(chan error, 1)
+	go func() { doneErr <- s.Done() }()
+
+	time.Sleep(20 * time.Millisecond)
+
+	if got := (<-s.C).Pos(); got != 0 {
+		t.Fatalf("got %d, expected 0", got)
+	}
+
+	if err := <-addDone; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-doneErr; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSequencerWrapAround(t *testing.T) {
+	// A tiny 3-bit counter (mod 8) so we can exercise a couple of
+	// rollovers without a huge test.
+	s := NewSequencer()
+	s.WrapMask = 7
+	s.WindowSize = 4
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		// Two full epochs plus a bit, fed out of order within
+		// each epoch: 0..7, 0..7, 0..2
+		for epoch := 0; epoch < 2; epoch++ {
+			for _, x := range []int64{2, 0, 1, 4, 3, 6, 5, 7} {
+				s.Add(seqint(x))
+			}
+		}
+		for _, x := range []int64{1, 0, 2} {
+			s.Add(seqint(x))
+		}
+
+		if err := s.Done(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	i := int64(0)
+	for range s.C {
+		i++
+	}
+	if i != 19 {
+		t.Fatalf("got %d items, expected 19", i)
+	}
+
+	wg.Wait()
+}